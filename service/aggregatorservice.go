@@ -19,16 +19,31 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/golang/glog"
+	"cloud.google.com/go/logging"
 	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsublite/pscompat"
 	"cloud.google.com/go/storage"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/runners/dataflow"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/runners/direct"
+	"github.com/google/privacy-sandbox-aggregation-service/pipeline/dpfaggregator"
 	"github.com/google/privacy-sandbox-aggregation-service/pipeline/ioutils"
 	"github.com/google/privacy-sandbox-aggregation-service/service/query"
 	"github.com/google/privacy-sandbox-aggregation-service/service/utils"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // DataflowCfg contains parameters necessary for running pipelines on Dataflow.
@@ -45,6 +60,403 @@ type ServerCfg struct {
 	DpfAggregatePartialReportBinary string
 }
 
+// TransportKind selects the Pub/Sub transport QueryHandler uses to move aggregation requests
+// between helper instances.
+type TransportKind string
+
+const (
+	// TransportPubSub uses standard Cloud Pub/Sub, the service's historical transport.
+	TransportPubSub TransportKind = "pubsub"
+	// TransportPubSubLite uses Pub/Sub Lite, for deployments that need its lower per-message cost or
+	// zonal topics. RequestPubSubTopic/RequestPubsubSubscription are then Pub/Sub Lite resource URIs
+	// of the form "pubsublite://project/location/name".
+	TransportPubSubLite TransportKind = "pubsublite"
+)
+
+const pubsubLiteResourcePrefix = "pubsublite://"
+
+// parsePubSubLiteResourceName parses a "pubsublite://project/location/name" URI, mirroring
+// utils.ParsePubSubResourceName for the Pub/Sub Lite transport.
+func parsePubSubLiteResourceName(uri string) (project, location, name string, err error) {
+	if !strings.HasPrefix(uri, pubsubLiteResourcePrefix) {
+		return "", "", "", fmt.Errorf("pubsub lite resource name %q must start with %q", uri, pubsubLiteResourcePrefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, pubsubLiteResourcePrefix), "/", 3)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("pubsub lite resource name %q must have the form %sproject/location/name", uri, pubsubLiteResourcePrefix)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// PipelineRunnerKind selects the PipelineBackend implementation QueryHandler uses to aggregate a level.
+type PipelineRunnerKind string
+
+const (
+	// RunnerDirect runs the aggregation pipeline in-process using Beam's direct runner.
+	RunnerDirect PipelineRunnerKind = "direct"
+	// RunnerDataflow runs the aggregation pipeline in-process using Beam's Dataflow runner.
+	RunnerDataflow PipelineRunnerKind = "dataflow"
+	// RunnerExec shells out to ServerCfg.DpfAggregatePartialReportBinary, matching the historical behavior.
+	RunnerExec PipelineRunnerKind = "exec"
+)
+
+// PipelineArgs carries the parameters needed to aggregate a single level of partial reports.
+type PipelineArgs struct {
+	PartialReportURI    string
+	SumParamsURI        string
+	PrefixesURI         string
+	PartialHistogramURI string
+	Epsilon             float64
+	PrivateKeyParamsURI string
+
+	// QueryID, Level, Origin and PartnerOrigin identify the request being aggregated, and are
+	// attached to every structured log entry the backend emits for this run.
+	QueryID       string
+	Level         int32
+	Origin        string
+	PartnerOrigin string
+}
+
+// PipelineLogEntry is the structured payload attached to aggregation-pipeline log entries.
+type PipelineLogEntry struct {
+	QueryID       string
+	Level         int32
+	Origin        string
+	PartnerOrigin string
+	Event         string
+	Message       string        `json:",omitempty"`
+	PipelineJobID string        `json:",omitempty"`
+	Elapsed       time.Duration `json:",omitempty"`
+	EpsilonSpent  float64       `json:",omitempty"`
+}
+
+// PipelineLogger writes structured aggregation-pipeline log entries. It's an interface so tests can
+// inject a fake in place of Cloud Logging.
+type PipelineLogger interface {
+	Log(severity logging.Severity, entry PipelineLogEntry)
+}
+
+// cloudPipelineLogger writes entries to Cloud Logging.
+type cloudPipelineLogger struct {
+	client *logging.Client
+	logger *logging.Logger
+}
+
+func (l *cloudPipelineLogger) Log(severity logging.Severity, entry PipelineLogEntry) {
+	l.logger.Log(logging.Entry{Severity: severity, Payload: entry})
+}
+
+// Close flushes buffered Cloud Logging entries and closes the underlying client. QueryHandler.Close
+// calls this via a type assertion, since glogPipelineLogger and test fakes don't need it.
+func (l *cloudPipelineLogger) Close() error {
+	return l.client.Close()
+}
+
+// glogPipelineLogger writes entries through glog, for when Cloud Logging credentials aren't
+// available.
+type glogPipelineLogger struct{}
+
+func (glogPipelineLogger) Log(severity logging.Severity, entry PipelineLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("marshaling pipeline log entry: %v", err)
+		return
+	}
+	if severity >= logging.Error {
+		log.Errorf("%s", b)
+	} else {
+		log.Infof("%s", b)
+	}
+}
+
+// PipelineResult reports the outcome of a successful pipeline run.
+type PipelineResult struct {
+	// JobID is the runner-assigned job identifier, e.g. a Dataflow job ID. Empty for runners without one.
+	JobID string
+}
+
+// PipelineError wraps a pipeline failure with whether the caller should retry it.
+type PipelineError struct {
+	Err       error
+	Transient bool
+}
+
+func (e *PipelineError) Error() string { return e.Err.Error() }
+
+func (e *PipelineError) Unwrap() error { return e.Err }
+
+// isTransientBeamErr reports whether err, returned by running a Beam pipeline, is worth retrying.
+// Dataflow job submission goes over gRPC, so an infra-side failure (the service being unavailable,
+// a deadline, exhausted quota) surfaces as a gRPC status; anything else - a DoFn erroring out on
+// malformed report data, for instance - will fail identically on every redelivery.
+func isTransientBeamErr(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTransientExecErr reports whether err, returned by running the worker binary, is worth retrying.
+// A process that exited on its own after running - the common case for malformed report data - will
+// fail identically on every redelivery; a process killed by a signal (e.g. the OOM killer or a
+// preemption) or a canceled context is an infra hiccup worth another attempt.
+func isTransientExecErr(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		// The binary never ran at all, e.g. it's missing; retrying won't fix that.
+		return false
+	}
+	if status, ok := exitErr.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return true
+	}
+	return false
+}
+
+// PipelineBackend runs the DPF aggregation pipeline for a single hierarchical-query level.
+type PipelineBackend interface {
+	Run(ctx context.Context, args *PipelineArgs) (*PipelineResult, error)
+}
+
+// beamBackend runs the aggregation pipeline in-process through the Beam Go SDK, using either the
+// direct or the Dataflow runner depending on the configured PipelineRunnerKind.
+type beamBackend struct {
+	runner       PipelineRunnerKind
+	dataflowCfg  DataflowCfg
+	workerBinary string
+	logger       PipelineLogger
+}
+
+func (b *beamBackend) Run(ctx context.Context, args *PipelineArgs) (*PipelineResult, error) {
+	start := time.Now()
+	b.logger.Log(logging.Info, PipelineLogEntry{
+		QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+		Event: "launched", EpsilonSpent: args.Epsilon,
+	})
+
+	p, s := beam.NewPipelineWithRoot()
+	if err := dpfaggregator.AggregatePartialReport(s, &dpfaggregator.AggregatePartialReportParams{
+		PartialReportURI:    args.PartialReportURI,
+		SumParamsURI:        args.SumParamsURI,
+		PrefixesURI:         args.PrefixesURI,
+		PartialHistogramURI: args.PartialHistogramURI,
+		Epsilon:             args.Epsilon,
+		PrivateKeyParamsURI: args.PrivateKeyParamsURI,
+	}); err != nil {
+		b.logFailed(args, start, err)
+		return nil, &PipelineError{Err: err, Transient: false}
+	}
+
+	// beamx's runner selection is a package-level flag parsed once at process startup, so it can't be
+	// redirected per call; invoke the direct/Dataflow runner packages directly instead.
+	var pr beam.PipelineResult
+	var err error
+	switch b.runner {
+	case RunnerDirect:
+		pr, err = direct.Execute(ctx, p)
+	case RunnerDataflow:
+		*dataflow.Project = b.dataflowCfg.Project
+		*dataflow.Region = b.dataflowCfg.Region
+		*dataflow.StagingLocation = b.dataflowCfg.StagingLocation
+		*dataflow.TempLocation = b.dataflowCfg.TempLocation
+		*dataflow.WorkerBinary = b.workerBinary
+		pr, err = dataflow.Execute(ctx, p)
+	default:
+		err = fmt.Errorf("unsupported beam runner %q", b.runner)
+	}
+	if err != nil {
+		b.logFailed(args, start, err)
+		return nil, &PipelineError{Err: err, Transient: isTransientBeamErr(ctx, err)}
+	}
+
+	result := &PipelineResult{}
+	// The Dataflow runner's PipelineResult additionally identifies the submitted job; direct-runner
+	// results don't, so this type assertion only succeeds for RunnerDataflow.
+	if jober, ok := pr.(interface{ JobID() string }); ok {
+		result.JobID = jober.JobID()
+	}
+	b.logger.Log(logging.Info, PipelineLogEntry{
+		QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+		Event: "completed", PipelineJobID: result.JobID, Elapsed: time.Since(start), EpsilonSpent: args.Epsilon,
+	})
+	return result, nil
+}
+
+func (b *beamBackend) logFailed(args *PipelineArgs, start time.Time, err error) {
+	b.logger.Log(logging.Error, PipelineLogEntry{
+		QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+		Event: "failed", Message: err.Error(), Elapsed: time.Since(start), EpsilonSpent: args.Epsilon,
+	})
+}
+
+// execBackend shells out to a standalone binary, reproducing the service's historical behavior.
+type execBackend struct {
+	binary      string
+	runner      PipelineRunnerKind
+	dataflowCfg DataflowCfg
+	logger      PipelineLogger
+}
+
+func (b *execBackend) Run(ctx context.Context, args *PipelineArgs) (*PipelineResult, error) {
+	start := time.Now()
+	cmdArgs := []string{
+		"--partial_report_file=" + args.PartialReportURI,
+		"--sum_parameters_file=" + args.SumParamsURI,
+		"--prefixes_file=" + args.PrefixesURI,
+		"--partial_histogram_file=" + args.PartialHistogramURI,
+		"--epsilon=" + fmt.Sprintf("%f", args.Epsilon),
+		"--private_key_params_uri=" + args.PrivateKeyParamsURI,
+		"--runner=" + string(b.runner),
+	}
+	if b.runner == RunnerDataflow {
+		cmdArgs = append(cmdArgs,
+			"--project="+b.dataflowCfg.Project,
+			"--region="+b.dataflowCfg.Region,
+			"--temp_location="+b.dataflowCfg.TempLocation,
+			"--staging_location="+b.dataflowCfg.StagingLocation,
+			"--worker_binary="+b.binary,
+		)
+	}
+
+	str := b.binary
+	for _, s := range cmdArgs {
+		str = fmt.Sprintf("%s\n%s", str, s)
+	}
+	b.logger.Log(logging.Info, PipelineLogEntry{
+		QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+		Event: "launched", Message: str, EpsilonSpent: args.Epsilon,
+	})
+
+	cmd := exec.CommandContext(ctx, b.binary, cmdArgs...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		b.logger.Log(logging.Error, PipelineLogEntry{
+			QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+			Event: "failed", Message: fmt.Sprintf("%s: %s", err, stderr.String()), Elapsed: time.Since(start), EpsilonSpent: args.Epsilon,
+		})
+		return nil, &PipelineError{Err: err, Transient: isTransientExecErr(ctx, err)}
+	}
+	b.logger.Log(logging.Info, PipelineLogEntry{
+		QueryID: args.QueryID, Level: args.Level, Origin: args.Origin, PartnerOrigin: args.PartnerOrigin,
+		Event: "completed", Message: out.String(), Elapsed: time.Since(start), EpsilonSpent: args.Epsilon,
+	})
+	return &PipelineResult{}, nil
+}
+
+// defaultPartnerWaitTimeout bounds how long PartnerResultWaiter blocks for a notification before
+// falling back to an explicit existence check, in case the notification was dropped or arrived
+// before the waiter started watching for it.
+const defaultPartnerWaitTimeout = 10 * time.Minute
+
+// PartnerResultWaiter notifies callers as soon as a partner helper's partial-result object appears
+// in GCS, fed by a Pub/Sub topic subscribed to the bucket's object-change notifications. This lets
+// aggregatePartialReportHierarchy block on a single message instead of failing it back to pubsub for
+// redelivery every time the partner's result for the previous level isn't ready yet.
+type PartnerResultWaiter struct {
+	sub     *pubsub.Subscription
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	waiting map[string][]chan struct{}
+}
+
+// NewPartnerResultWaiter creates a waiter that demultiplexes the notifications delivered to sub
+// across any number of concurrently in-flight queries.
+func NewPartnerResultWaiter(sub *pubsub.Subscription) *PartnerResultWaiter {
+	return &PartnerResultWaiter{sub: sub, Timeout: defaultPartnerWaitTimeout, waiting: make(map[string][]chan struct{})}
+}
+
+// gcsObjectFinalizeEvent is the eventType attribute GCS sets on a Pub/Sub object-change
+// notification for an object being created or overwritten. See
+// https://cloud.google.com/storage/docs/pubsub-notifications.
+const gcsObjectFinalizeEvent = "OBJECT_FINALIZE"
+
+// Start listens for object-change notifications until ctx is canceled. Call it once, before any
+// call to Wait; it blocks, so callers should run it in its own goroutine.
+func (w *PartnerResultWaiter) Start(ctx context.Context) error {
+	return w.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		w.handleNotification(msg)
+	})
+}
+
+// handleNotification wakes every Wait call blocked on the object the notification msg reports,
+// unless msg reports something other than the object being finalized. Split out from Start so it
+// can be exercised directly in tests, without a live Pub/Sub subscription.
+func (w *PartnerResultWaiter) handleNotification(msg *pubsub.Message) {
+	// A notification config not scoped to finalize events only would otherwise also deliver
+	// deletes and metadata updates, which don't mean the partner's result object is readable yet.
+	if msg.Attributes["eventType"] != gcsObjectFinalizeEvent {
+		return
+	}
+	// bucketId/objectId are the attributes GCS sets on its Pub/Sub object-change notifications.
+	uri := fmt.Sprintf("gs://%s/%s", msg.Attributes["bucketId"], msg.Attributes["objectId"])
+
+	w.mu.Lock()
+	chans := w.waiting[uri]
+	delete(w.waiting, uri)
+	w.mu.Unlock()
+	for _, ch := range chans {
+		close(ch)
+	}
+}
+
+// Wait blocks until uri is reported ready by a notification, ctx is canceled, or Timeout elapses, in
+// which case it falls back to an explicit existence check against gcsClient.
+func (w *PartnerResultWaiter) Wait(ctx context.Context, gcsClient *storage.Client, uri string) error {
+	ch := make(chan struct{})
+	w.mu.Lock()
+	w.waiting[uri] = append(w.waiting[uri], ch)
+	w.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		w.removeWaiter(uri, ch)
+		return ctx.Err()
+	case <-time.After(w.Timeout):
+		w.removeWaiter(uri, ch)
+		exist, err := utils.IsGCSObjectExist(ctx, gcsClient, uri)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return fmt.Errorf("timed out after %s waiting for partner result %s", w.Timeout, uri)
+		}
+		return nil
+	}
+}
+
+// removeWaiter deletes ch from w.waiting[uri], for the ctx.Done()/timeout exits from Wait where a
+// notification never arrived to do it. It's a no-op if ch already isn't there, e.g. a notification
+// won the race to deliver on it concurrently.
+func (w *PartnerResultWaiter) removeWaiter(uri string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	chans := w.waiting[uri]
+	for i, c := range chans {
+		if c == ch {
+			chans = append(chans[:i], chans[i+1:]...)
+			break
+		}
+	}
+	if len(chans) == 0 {
+		delete(w.waiting, uri)
+	} else {
+		w.waiting[uri] = chans
+	}
+}
+
 // SharedInfoHandler handles HTTP requests for the information shared with other helpers.
 type SharedInfoHandler struct {
 	SharedInfo *query.HelperSharedInfo
@@ -61,64 +473,421 @@ func (h *SharedInfoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	fmt.Fprint(w, b)
 }
 
+// JobState is the lifecycle state of a hierarchical query, as tracked by JobStatus.
+type JobState string
+
+const (
+	// JobStateRunning means the current level's pipeline is running.
+	JobStateRunning JobState = "running"
+	// JobStateWaitingForPartner means the current level is blocked on the partner helper's result
+	// for the previous level.
+	JobStateWaitingForPartner JobState = "waiting_for_partner"
+	// JobStateCompleted means every level of the query has finished successfully.
+	JobStateCompleted JobState = "completed"
+	// JobStateFailed means the query stopped on an error that won't clear on redelivery.
+	JobStateFailed JobState = "failed"
+)
+
+// LevelProgress records the timing and outcome of a single level of a hierarchical query.
+type LevelProgress struct {
+	Level         int32
+	StartTime     time.Time
+	FinishTime    time.Time `json:",omitempty"`
+	PipelineJobID string    `json:",omitempty"`
+}
+
+// JobStatus is the persisted, per-query progress record JobStatusHandler reports and QueryHandler
+// updates as it advances a hierarchical query through its levels.
+type JobStatus struct {
+	QueryID string
+	State   JobState
+	Levels  []LevelProgress
+	Error   string `json:",omitempty"`
+}
+
+// jobStatusURI returns the GCS object a query's JobStatus is persisted to under dir.
+func jobStatusURI(dir, queryID string) string {
+	return fmt.Sprintf("%s/job_status/%s.json", strings.TrimSuffix(dir, "/"), queryID)
+}
+
+// readJobStatus reads the JobStatus persisted at uri. It returns a fresh JobStatus for queryID if
+// nothing has been persisted yet.
+func readJobStatus(ctx context.Context, uri, queryID string) (*JobStatus, error) {
+	b, err := ioutils.ReadBytes(ctx, uri)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return &JobStatus{QueryID: queryID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status := &JobStatus{}
+	if err := json.Unmarshal(b, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// writeJobStatus persists status to uri.
+func writeJobStatus(ctx context.Context, uri string, status *JobStatus) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return ioutils.WriteBytes(ctx, b, uri)
+}
+
+// splitGCSURI splits a "gs://bucket/object" URI into its bucket and object components.
+func splitGCSURI(uri string) (bucket, object string, err error) {
+	const prefix = "gs://"
+	if !strings.HasPrefix(uri, prefix) {
+		return "", "", fmt.Errorf("GCS URI %q must start with %q", uri, prefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, prefix), "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("GCS URI %q must have the form gs://bucket/object", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+// doneMarkerURI returns the GCS object aggregatePartialReportHierarchy uses to mark a query's level
+// as successfully aggregated, so a pubsub redelivery of that level can be recognized and skipped.
+func doneMarkerURI(dir, queryID string, level int32) string {
+	return fmt.Sprintf("%s/%s/%d.done", strings.TrimSuffix(dir, "/"), queryID, level)
+}
+
+// publishedMarkerURI returns the GCS object publishNextLevel uses to mark that it already published
+// the message advancing queryID past level, so a redelivery that reaches it again - e.g. because the
+// publish ack raced a Nack-triggering timeout - doesn't publish a duplicate.
+func publishedMarkerURI(dir, queryID string, level int32) string {
+	return fmt.Sprintf("%s/%s/%d.published", strings.TrimSuffix(dir, "/"), queryID, level)
+}
+
+// writeMarker creates an empty marker object at uri if one doesn't already exist. The precondition
+// makes the write idempotent under concurrent callers: whichever one loses the race simply finds the
+// marker already there.
+func writeMarker(ctx context.Context, gcsClient *storage.Client, uri string) error {
+	bucket, object, err := splitGCSURI(uri)
+	if err != nil {
+		return err
+	}
+	w := gcsClient.Bucket(bucket).Object(object).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if err := w.Close(); err != nil {
+		// The JSON API client reports a failed precondition as HTTP 412, the gRPC client as FailedPrecondition.
+		var apiErr *googleapi.Error
+		if status.Code(err) == codes.FailedPrecondition || (errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// levelDedup suppresses concurrent in-process handling of the same hierarchical-query level, e.g. a
+// pubsub redelivery landing while the original delivery is still being processed. It only guards a
+// single replica; the done marker is what makes level advancement safe across replicas.
+type levelDedup struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newLevelDedup() *levelDedup {
+	return &levelDedup{running: make(map[string]bool)}
+}
+
+func (d *levelDedup) tryStart(queryID string, level int32) bool {
+	key := fmt.Sprintf("%s/%d", queryID, level)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running[key] {
+		return false
+	}
+	d.running[key] = true
+	return true
+}
+
+func (d *levelDedup) finish(queryID string, level int32) {
+	key := fmt.Sprintf("%s/%d", queryID, level)
+	d.mu.Lock()
+	delete(d.running, key)
+	d.mu.Unlock()
+}
+
+// JobStatusHandler serves the hierarchical-query progress QueryHandler persists to GCS. It handles:
+//
+//	GET /jobs/{queryID}     - the status of a single query
+//	GET /jobs?state=running - every query currently in the given state
+type JobStatusHandler struct {
+	GCSClient *storage.Client
+	// StatusDir is the GCS directory QueryHandler.JobStatusDir persists job status under.
+	StatusDir string
+}
+
+func (h *JobStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	if queryID := strings.TrimPrefix(req.URL.Path, "/jobs/"); queryID != "" && queryID != req.URL.Path {
+		status, err := readJobStatus(ctx, jobStatusURI(h.StatusDir, queryID), queryID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.writeJSON(w, status)
+		return
+	}
+
+	statuses, err := h.listJobStatuses(ctx, JobState(req.URL.Query().Get("state")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.writeJSON(w, statuses)
+}
+
+func (h *JobStatusHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(b))
+}
+
+// listJobStatuses returns every persisted JobStatus under StatusDir, optionally filtered to a state.
+func (h *JobStatusHandler) listJobStatuses(ctx context.Context, state JobState) ([]*JobStatus, error) {
+	bucket, prefix, err := splitGCSURI(fmt.Sprintf("%s/job_status/", strings.TrimSuffix(h.StatusDir, "/")))
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []*JobStatus
+	it := h.GCSClient.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutils.ReadBytes(ctx, fmt.Sprintf("gs://%s/%s", bucket, attrs.Name))
+		if err != nil {
+			return nil, err
+		}
+		status := &JobStatus{}
+		if err := json.Unmarshal(b, status); err != nil {
+			return nil, err
+		}
+		if state == "" || status.State == state {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
 // QueryHandler handles the request in the pubsub messages.
 type QueryHandler struct {
 	ServerCfg                 ServerCfg
-	PipelineRunner            string
+	PipelineRunner            PipelineRunnerKind
 	DataflowCfg               DataflowCfg
 	Origin                    string
 	SharedDir                 string
 	RequestPubSubTopic        string
 	RequestPubsubSubscription string
+	// NotificationSubscription, if set, names a Pub/Sub subscription fed by a GCS bucket's
+	// object-change notifications. It lets aggregatePartialReportHierarchy wait on the partner
+	// helper's result instead of failing back to pubsub redelivery while it's missing.
+	NotificationSubscription string
+	// Transport selects the Pub/Sub transport used for RequestPubSubTopic/RequestPubsubSubscription.
+	// It defaults to TransportPubSub.
+	Transport TransportKind
+	// JobStatusDir is the GCS directory per-query JobStatus progress is persisted under. It defaults
+	// to SharedDir and is served by a JobStatusHandler pointed at the same directory.
+	JobStatusDir string
+	// CloudLoggingProject, if set, is the project QueryHandler writes structured pipeline logs to via
+	// Cloud Logging. If empty, or if a Cloud Logging client can't be created (e.g. no credentials are
+	// available), QueryHandler falls back to writing the same structured entries through glog.
+	CloudLoggingProject string
+	// Logger overrides how QueryHandler emits structured pipeline log entries; tests can set this to
+	// inject a fake. If nil, Setup populates it based on CloudLoggingProject.
+	Logger PipelineLogger
+	// ExecRunner is the Beam runner name passed to ServerCfg.DpfAggregatePartialReportBinary when
+	// PipelineRunner is RunnerExec. The binary needs an actual Beam runner (RunnerDirect or
+	// RunnerDataflow), not the literal value "exec", which only selects the backend implementation.
+	// Defaults to RunnerDirect.
+	ExecRunner PipelineRunnerKind
 
 	PubSubTopicClient, PubSubSubscriptionClient *pubsub.Client
 	GCSClient                                   *storage.Client
+
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+
+	backend       PipelineBackend
+	partnerWaiter *PartnerResultWaiter
+	dedup         *levelDedup
 }
 
 // Setup creates the cloud API clients.
 func (h *QueryHandler) Setup(ctx context.Context) error {
-	topicProject, _, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+	var subscriptionProject string
+	switch h.Transport {
+	case TransportPubSubLite:
+		var err error
+		subscriptionProject, err = h.setupPubSubLite(ctx)
+		if err != nil {
+			return err
+		}
+	case TransportPubSub, "":
+		var err error
+		subscriptionProject, err = h.setupPubSub(ctx)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported transport %q", h.Transport)
+	}
+
+	gcsClient, err := storage.NewClient(ctx)
 	if err != nil {
 		return err
 	}
-	h.PubSubTopicClient, err = pubsub.NewClient(ctx, topicProject)
+	h.GCSClient = gcsClient
+
+	if h.Logger == nil {
+		h.Logger = h.newPipelineLogger(ctx)
+	}
+	h.dedup = newLevelDedup()
+
+	switch h.PipelineRunner {
+	case RunnerDirect, RunnerDataflow:
+		h.backend = &beamBackend{runner: h.PipelineRunner, dataflowCfg: h.DataflowCfg, workerBinary: h.ServerCfg.DpfAggregatePartialReportBinary, logger: h.Logger}
+	case RunnerExec, "":
+		execRunner := h.ExecRunner
+		if execRunner == "" {
+			execRunner = RunnerDirect
+		}
+		if execRunner != RunnerDirect && execRunner != RunnerDataflow {
+			return fmt.Errorf("unsupported exec runner %q", execRunner)
+		}
+		h.backend = &execBackend{binary: h.ServerCfg.DpfAggregatePartialReportBinary, runner: execRunner, dataflowCfg: h.DataflowCfg, logger: h.Logger}
+	default:
+		return fmt.Errorf("unsupported pipeline runner %q", h.PipelineRunner)
+	}
+
+	if h.NotificationSubscription != "" {
+		notificationProject, notificationSubID, err := utils.ParsePubSubResourceName(h.NotificationSubscription)
+		if err != nil {
+			return err
+		}
+		// GCS object-change notifications are always delivered over standard Pub/Sub, never Lite, so
+		// h.PubSubSubscriptionClient can only be reused when it's itself a standard Pub/Sub client for
+		// the same project; Lite transport never populates it.
+		notificationClient := h.PubSubSubscriptionClient
+		if h.Transport == TransportPubSubLite || notificationProject != subscriptionProject {
+			if notificationClient, err = pubsub.NewClient(ctx, notificationProject); err != nil {
+				return err
+			}
+		}
+		h.partnerWaiter = NewPartnerResultWaiter(notificationClient.Subscription(notificationSubID))
+		go func() {
+			if err := h.partnerWaiter.Start(ctx); err != nil {
+				log.Errorf("partner result waiter stopped: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// newPipelineLogger creates a Cloud Logging-backed PipelineLogger for CloudLoggingProject, falling
+// back to glog when the project isn't configured or Cloud Logging credentials aren't available.
+func (h *QueryHandler) newPipelineLogger(ctx context.Context) PipelineLogger {
+	if h.CloudLoggingProject == "" {
+		return glogPipelineLogger{}
+	}
+	client, err := logging.NewClient(ctx, h.CloudLoggingProject)
 	if err != nil {
-		return err
+		log.Warningf("creating Cloud Logging client, falling back to glog: %v", err)
+		return glogPipelineLogger{}
 	}
+	return &cloudPipelineLogger{client: client, logger: client.Logger("aggregation-pipeline")}
+}
 
-	subscriptionProject, _, err := utils.ParsePubSubResourceName(h.RequestPubsubSubscription)
+// setupPubSub wires up the standard Cloud Pub/Sub transport and returns the subscription's project.
+func (h *QueryHandler) setupPubSub(ctx context.Context) (string, error) {
+	topicProject, topicID, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
 	if err != nil {
-		return err
+		return "", err
 	}
+	h.PubSubTopicClient, err = pubsub.NewClient(ctx, topicProject)
+	if err != nil {
+		return "", err
+	}
+	h.topic = h.PubSubTopicClient.Topic(topicID)
+	// Every level of a hierarchical query is published with its QueryID as the ordering key, so a
+	// subscriber never observes level N+1 before level N.
+	h.topic.EnableMessageOrdering = true
 
+	subscriptionProject, subID, err := utils.ParsePubSubResourceName(h.RequestPubsubSubscription)
+	if err != nil {
+		return "", err
+	}
 	if subscriptionProject == topicProject {
 		h.PubSubSubscriptionClient = h.PubSubTopicClient
 	} else {
 		h.PubSubSubscriptionClient, err = pubsub.NewClient(ctx, subscriptionProject)
 		if err != nil {
-			return err
+			return "", err
 		}
+	}
+	h.subscription = h.PubSubSubscriptionClient.Subscription(subID)
+	return subscriptionProject, nil
+}
 
+// setupPubSubLite wires up the Pub/Sub Lite transport and returns the subscription's project.
+// pscompat's clients implement the same Publish/Receive surface as the standard pubsub.Topic and
+// pubsub.Subscription, so the rest of QueryHandler doesn't need to know which transport is in use.
+func (h *QueryHandler) setupPubSubLite(ctx context.Context) (string, error) {
+	topicProject, topicLocation, topicName, err := parsePubSubLiteResourceName(h.RequestPubSubTopic)
+	if err != nil {
+		return "", err
+	}
+	h.topic, err = pscompat.NewPublisherClient(ctx, pscompat.PublishSettings{}, pscompat.TopicPath{Project: topicProject, Zone: topicLocation, TopicID: topicName})
+	if err != nil {
+		return "", err
 	}
+	// Keep all levels of a hierarchical query on the same partition, so a replica processing level N
+	// always observes messages in the order the previous levels were published.
+	h.topic.EnableMessageOrdering = true
 
-	h.GCSClient, err = storage.NewClient(ctx)
-	return err
+	subscriptionProject, subLocation, subName, err := parsePubSubLiteResourceName(h.RequestPubsubSubscription)
+	if err != nil {
+		return "", err
+	}
+	h.subscription, err = pscompat.NewSubscriberClient(ctx, pscompat.ReceiveSettings{}, pscompat.SubscriptionPath{Project: subscriptionProject, Zone: subLocation, SubscriptionID: subName})
+	return subscriptionProject, err
 }
 
 // Close closes the cloud API clients.
 func (h *QueryHandler) Close() {
-	h.PubSubTopicClient.Close()
-	h.PubSubSubscriptionClient.Close()
+	h.topic.Stop()
+	if h.Transport != TransportPubSubLite {
+		h.PubSubTopicClient.Close()
+		h.PubSubSubscriptionClient.Close()
+	}
 	h.GCSClient.Close()
+	// Cloud Logging buffers entries client-side; flush them out instead of dropping whatever hasn't
+	// been sent yet. glogPipelineLogger and test fakes don't need closing, hence the type assertion.
+	if closer, ok := h.Logger.(interface{ Close() error }); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("closing pipeline logger: %v", err)
+		}
+	}
 }
 
 // SetupPullRequests gets ready to pull requests contained in a PubSub message subscription, and handles the request.
 func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
-	_, subID, err := utils.ParsePubSubResourceName(h.RequestPubsubSubscription)
-	if err != nil {
-		return err
-	}
-	sub := h.PubSubSubscriptionClient.Subscription(subID)
+	sub := h.subscription
 
 	// Only allow pulling one message at a time to avoid overloading the memory.
 	sub.ReceiveSettings.Synchronous = true
@@ -133,6 +902,13 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 		}
 		if err := h.aggregatePartialReportHierarchy(ctx, request); err != nil {
 			log.Error(err)
+			var pipelineErr *PipelineError
+			if errors.As(err, &pipelineErr) && !pipelineErr.Transient {
+				// The failure won't clear on redelivery, so ack it to stop pubsub from retrying forever.
+				log.Errorf("terminal failure for query %q, not retrying: %v", request.QueryID, pipelineErr)
+				msg.Ack()
+				return
+			}
 			msg.Nack()
 			return
 		}
@@ -140,7 +916,45 @@ func (h *QueryHandler) SetupPullRequests(ctx context.Context) error {
 	})
 }
 
+// statusDir returns the directory QueryHandler persists JobStatus to, defaulting to SharedDir.
+func (h *QueryHandler) statusDir() string {
+	if h.JobStatusDir != "" {
+		return h.JobStatusDir
+	}
+	return h.SharedDir
+}
+
+// updateJobStatus loads the persisted JobStatus for queryID, applies mutate, and persists the
+// result. Status is a best-effort observability side channel, so failures are logged rather than
+// propagated: a query shouldn't fail just because its progress couldn't be recorded.
+func (h *QueryHandler) updateJobStatus(ctx context.Context, queryID string, mutate func(*JobStatus)) {
+	uri := jobStatusURI(h.statusDir(), queryID)
+	status, err := readJobStatus(ctx, uri, queryID)
+	if err != nil {
+		log.Errorf("reading job status for %q: %v", queryID, err)
+		return
+	}
+	mutate(status)
+	if err := writeJobStatus(ctx, uri, status); err != nil {
+		log.Errorf("persisting job status for %q: %v", queryID, err)
+	}
+}
+
 func (h *QueryHandler) aggregatePartialReportHierarchy(ctx context.Context, request *query.AggregateRequest) error {
+	h.Logger.Log(logging.Info, PipelineLogEntry{
+		QueryID: request.QueryID, Level: request.Level, Origin: h.Origin, PartnerOrigin: request.PartnerSharedInfo.Origin,
+		Event: "received",
+	})
+
+	// Guard against a redelivery of this level racing the in-flight handling of the original message
+	// within this replica. Redeliveries that land after the original finished are instead caught by
+	// the done marker below.
+	if !h.dedup.tryStart(request.QueryID, request.Level) {
+		log.Infof("level %d of query %q is already being processed, dropping redelivery", request.Level, request.QueryID)
+		return nil
+	}
+	defer h.dedup.finish(request.QueryID, request.Level)
+
 	config, err := query.ReadExpansionConfigFile(ctx, request.ExpandConfigURI)
 	if err != nil {
 		return nil
@@ -151,17 +965,48 @@ func (h *QueryHandler) aggregatePartialReportHierarchy(ctx context.Context, requ
 		return fmt.Errorf("expect request level <= finalLevel %d, got %d", finalLevel, request.Level)
 	}
 
-	// If it is not the first-level aggregation, check if the result from the partner helper is ready for the previous level.
-	if request.Level > 0 {
-		exist, err := utils.IsGCSObjectExist(ctx, h.GCSClient,
-			query.GetRequestPartialResultURI(request.PartnerSharedInfo.SharedDir, request.QueryID, request.Level-1),
-		)
-		if err != nil {
-			return err
+	// A pubsub redelivery of an already-completed level would otherwise re-run the pipeline and
+	// double-publish the next level, double-spending its privacy budget. Skip straight to publishing
+	// the next level if the marker from a prior successful run is already there.
+	doneURI := doneMarkerURI(h.statusDir(), request.QueryID, request.Level)
+	done, err := utils.IsGCSObjectExist(ctx, h.GCSClient, doneURI)
+	if err != nil {
+		return err
+	}
+	if done {
+		if request.Level == finalLevel {
+			// A redelivery of an already-completed final level: there's no next level to publish.
+			log.Infof("level %d of query %q is already done and final, marking complete", request.Level, request.QueryID)
+			h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) { s.State = JobStateCompleted })
+			return nil
 		}
-		if !exist {
-			// When the partial result from the partner helper is not ready, nack the message with an error.
-			return fmt.Errorf("result from %s for level %s is not ready", request.PartnerSharedInfo.Origin, request.QueryID)
+		log.Infof("level %d of query %q is already done, skipping straight to publishing the next level", request.Level, request.QueryID)
+		return h.publishNextLevel(ctx, request, &PipelineResult{})
+	}
+
+	// If it is not the first-level aggregation, wait for the result from the partner helper for the
+	// previous level to become ready.
+	if request.Level > 0 {
+		h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) { s.State = JobStateWaitingForPartner })
+		h.Logger.Log(logging.Info, PipelineLogEntry{
+			QueryID: request.QueryID, Level: request.Level, Origin: h.Origin, PartnerOrigin: request.PartnerSharedInfo.Origin,
+			Event: "waiting-for-partner",
+		})
+
+		partnerResultURI := query.GetRequestPartialResultURI(request.PartnerSharedInfo.SharedDir, request.QueryID, request.Level-1)
+		if h.partnerWaiter != nil {
+			if err := h.partnerWaiter.Wait(ctx, h.GCSClient, partnerResultURI); err != nil {
+				return err
+			}
+		} else {
+			exist, err := utils.IsGCSObjectExist(ctx, h.GCSClient, partnerResultURI)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				// When the partial result from the partner helper is not ready, nack the message with an error.
+				return fmt.Errorf("result from %s for query %s is not ready", request.PartnerSharedInfo.Origin, request.QueryID)
+			}
 		}
 	}
 
@@ -181,56 +1026,95 @@ func (h *QueryHandler) aggregatePartialReportHierarchy(ctx context.Context, requ
 		outputResultURI = query.GetRequestPartialResultURI(h.SharedDir, request.QueryID, request.Level)
 	}
 
-	args := []string{
-		"--partial_report_file=" + request.PartialReportURI,
-		"--sum_parameters_file=" + request.SumParamsURI,
-		"--prefixes_file=" + request.PrefixesURI,
-		"--partial_histogram_file=" + outputResultURI,
-		"--epsilon=" + fmt.Sprintf("%f", request.TotalEpsilon*config.PrivacyBudgetPerPrefix[request.Level]),
-		"--private_key_params_uri=" + h.ServerCfg.PrivateKeyParamsURI,
-		"--runner=" + h.PipelineRunner,
-	}
+	h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) {
+		s.State = JobStateRunning
+		s.Levels = append(s.Levels, LevelProgress{Level: request.Level, StartTime: time.Now()})
+	})
 
-	if h.PipelineRunner == "dataflow" {
-		args = append(args,
-			"--project="+h.DataflowCfg.Project,
-			"--region="+h.DataflowCfg.Region,
-			"--temp_location="+h.DataflowCfg.TempLocation,
-			"--staging_location="+h.DataflowCfg.StagingLocation,
-			"--worker_binary="+h.ServerCfg.DpfAggregatePartialReportBinary,
-		)
+	result, err := h.backend.Run(ctx, &PipelineArgs{
+		PartialReportURI:    request.PartialReportURI,
+		SumParamsURI:        request.SumParamsURI,
+		PrefixesURI:         request.PrefixesURI,
+		PartialHistogramURI: outputResultURI,
+		Epsilon:             request.TotalEpsilon * config.PrivacyBudgetPerPrefix[request.Level],
+		PrivateKeyParamsURI: h.ServerCfg.PrivateKeyParamsURI,
+		QueryID:             request.QueryID,
+		Level:               request.Level,
+		Origin:              h.Origin,
+		PartnerOrigin:       request.PartnerSharedInfo.Origin,
+	})
+	if err != nil {
+		// A transient failure is nacked and retried, so only a terminal one marks the query failed.
+		var pipelineErr *PipelineError
+		if errors.As(err, &pipelineErr) && !pipelineErr.Transient {
+			h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) {
+				s.State = JobStateFailed
+				s.Error = err.Error()
+			})
+		}
+		return err
 	}
-
-	str := h.ServerCfg.DpfAggregatePartialReportBinary
-	for _, s := range args {
-		str = fmt.Sprintf("%s\n%s", str, s)
+	if result.JobID != "" {
+		log.Infof("query %q level %d ran as pipeline job %q", request.QueryID, request.Level, result.JobID)
 	}
-	log.Infof("Running command\n%s", str)
+	h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) {
+		if n := len(s.Levels); n > 0 {
+			s.Levels[n-1].FinishTime = time.Now()
+			s.Levels[n-1].PipelineJobID = result.JobID
+		}
+	})
 
-	cmd := exec.CommandContext(ctx, h.ServerCfg.DpfAggregatePartialReportBinary, args...)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err = cmd.Run()
-	if err != nil {
-		log.Errorf("%s: %s", err, stderr.String())
+	// Mark the level done before publishing the next one, so a redelivery of this message - even one
+	// racing a concurrent replica - finds the marker and skips re-running the pipeline.
+	if err := writeMarker(ctx, h.GCSClient, doneURI); err != nil {
 		return err
 	}
-	log.Infof("output of cmd: %s", out.String())
 
 	if request.Level == finalLevel {
 		log.Infof("query %q complete", request.QueryID)
+		h.updateJobStatus(ctx, request.QueryID, func(s *JobStatus) { s.State = JobStateCompleted })
+		return nil
+	}
+	return h.publishNextLevel(ctx, request, result)
+}
+
+// publishNextLevel advances request to the next level and publishes it, carrying the job ID that
+// produced the current level's result (if any) as a message attribute. Every message for a query is
+// published with request.QueryID as its ordering key, so a replica never observes level N+1 before
+// level N even when ordering keys are enabled on the topic.
+//
+// The done marker only stops this level's pipeline from re-running on redelivery; without a marker
+// of its own, a redelivery that reaches publishNextLevel again - e.g. because the publish ack raced
+// a Nack-triggering timeout - would publish another duplicate of the next-level message, and each
+// duplicate would go on to do the same thing to the level after it. publishNextLevel guards against
+// that by only ever publishing once per (QueryID, Level).
+func (h *QueryHandler) publishNextLevel(ctx context.Context, request *query.AggregateRequest, result *PipelineResult) error {
+	publishedURI := publishedMarkerURI(h.statusDir(), request.QueryID, request.Level)
+	published, err := utils.IsGCSObjectExist(ctx, h.GCSClient, publishedURI)
+	if err != nil {
+		return err
+	}
+	if published {
+		log.Infof("level %d of query %q was already published, not publishing a duplicate", request.Level, request.QueryID)
 		return nil
 	}
 
-	// If the hierarchical query is not finished yet, publish the requests for the next-level aggregation.
 	request.Level++
-	_, topic, err := utils.ParsePubSubResourceName(h.RequestPubSubTopic)
+	msg := &pubsub.Message{OrderingKey: request.QueryID}
+	if result.JobID != "" {
+		// Carry the job ID that produced this level's result as a message attribute, so it can be
+		// correlated with the pipeline that ran it without round-tripping through the request payload.
+		msg.Attributes = map[string]string{"pipelineJobID": result.JobID}
+	}
+	data, err := json.Marshal(request)
 	if err != nil {
 		return err
 	}
-	return utils.PublishRequest(ctx, h.PubSubTopicClient, topic, request)
+	msg.Data = data
+	if _, err := h.topic.Publish(ctx, msg).Get(ctx); err != nil {
+		return err
+	}
+	return writeMarker(ctx, h.GCSClient, publishedURI)
 }
 
 // ReadHelperSharedInfo reads the helper shared info from a URL.
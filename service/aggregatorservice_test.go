@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregatorservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+func TestLevelDedup(t *testing.T) {
+	d := newLevelDedup()
+
+	if !d.tryStart("query-1", 0) {
+		t.Fatal("tryStart on an unseen (queryID, level) = false, want true")
+	}
+	if d.tryStart("query-1", 0) {
+		t.Fatal("tryStart on an already-running (queryID, level) = true, want false")
+	}
+	// A different level of the same query, or the same level of a different query, isn't blocked by
+	// the first.
+	if !d.tryStart("query-1", 1) {
+		t.Fatal("tryStart on a different level = false, want true")
+	}
+	if !d.tryStart("query-2", 0) {
+		t.Fatal("tryStart on a different query = false, want true")
+	}
+
+	d.finish("query-1", 0)
+	if !d.tryStart("query-1", 0) {
+		t.Fatal("tryStart after finish = false, want true")
+	}
+}
+
+func TestDoneMarkerURI(t *testing.T) {
+	got := doneMarkerURI("gs://bucket/shared/", "query-1", 2)
+	want := "gs://bucket/shared/query-1/2.done"
+	if got != want {
+		t.Errorf("doneMarkerURI() = %q, want %q", got, want)
+	}
+}
+
+func TestPublishedMarkerURI(t *testing.T) {
+	got := publishedMarkerURI("gs://bucket/shared/", "query-1", 2)
+	want := "gs://bucket/shared/query-1/2.published"
+	if got != want {
+		t.Errorf("publishedMarkerURI() = %q, want %q", got, want)
+	}
+}
+
+func TestSplitGCSURI(t *testing.T) {
+	bucket, object, err := splitGCSURI("gs://bucket/path/to/object")
+	if err != nil {
+		t.Fatalf("splitGCSURI() returned error: %v", err)
+	}
+	if bucket != "bucket" || object != "path/to/object" {
+		t.Errorf("splitGCSURI() = (%q, %q), want (\"bucket\", \"path/to/object\")", bucket, object)
+	}
+
+	if _, _, err := splitGCSURI("not-a-gcs-uri"); err == nil {
+		t.Error("splitGCSURI(\"not-a-gcs-uri\") returned nil error, want non-nil")
+	}
+}
+
+func TestPartnerResultWaiterHandleNotificationWakesWaiters(t *testing.T) {
+	w := NewPartnerResultWaiter(nil)
+	const uri = "gs://bucket/shared/query-1/0.avro"
+
+	done := make(chan error, 1)
+	go func() { done <- w.Wait(context.Background(), nil, uri) }()
+
+	// Give Wait a chance to register itself before the notification arrives.
+	time.Sleep(10 * time.Millisecond)
+	w.handleNotification(&pubsub.Message{Attributes: map[string]string{
+		"eventType": gcsObjectFinalizeEvent,
+		"bucketId":  "bucket",
+		"objectId":  "shared/query-1/0.avro",
+	}})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait() did not return after a matching finalize notification")
+	}
+	if _, ok := w.waiting[uri]; ok {
+		t.Errorf("waiting[%q] still has an entry after the waiter fired", uri)
+	}
+}
+
+func TestPartnerResultWaiterHandleNotificationIgnoresNonFinalizeEvents(t *testing.T) {
+	w := NewPartnerResultWaiter(nil)
+	const uri = "gs://bucket/shared/query-1/0.avro"
+
+	done := make(chan error, 1)
+	go func() { done <- w.Wait(context.Background(), nil, uri) }()
+	time.Sleep(10 * time.Millisecond)
+
+	w.handleNotification(&pubsub.Message{Attributes: map[string]string{
+		"eventType": "OBJECT_DELETE",
+		"bucketId":  "bucket",
+		"objectId":  "shared/query-1/0.avro",
+	}})
+
+	select {
+	case err := <-done:
+		t.Fatalf("Wait() returned %v after a non-finalize notification, want it to keep blocking", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPartnerResultWaiterWaitContextCanceledRemovesWaiter(t *testing.T) {
+	w := NewPartnerResultWaiter(nil)
+	const uri = "gs://bucket/shared/query-1/0.avro"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Wait(ctx, nil, uri); err == nil {
+		t.Error("Wait() with an already-canceled context returned nil error, want non-nil")
+	}
+	if _, ok := w.waiting[uri]; ok {
+		t.Errorf("waiting[%q] still has an entry after Wait returned on context cancellation", uri)
+	}
+}
+
+func TestIsTransientExecErr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !isTransientExecErr(ctx, errors.New("boom")) {
+		t.Error("isTransientExecErr() with a canceled context = false, want true")
+	}
+
+	if isTransientExecErr(context.Background(), errors.New("binary not found")) {
+		t.Error("isTransientExecErr() for a non-exec.ExitError = true, want false")
+	}
+}
+
+func TestIsTransientBeamErr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !isTransientBeamErr(ctx, errors.New("boom")) {
+		t.Error("isTransientBeamErr() with a canceled context = false, want true")
+	}
+
+	if isTransientBeamErr(context.Background(), errors.New("malformed report data")) {
+		t.Error("isTransientBeamErr() for a plain non-gRPC error = true, want false")
+	}
+}